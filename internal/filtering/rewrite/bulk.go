@@ -0,0 +1,224 @@
+package rewrite
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// ImportSummary describes the outcome of a bulk import.
+type ImportSummary struct {
+	// Added is the number of rewrite items that were added.
+	Added int `json:"added"`
+
+	// Duplicate is the number of items that were already present in the
+	// storage and so weren't added again.
+	Duplicate int `json:"duplicate"`
+
+	// Skipped is the number of lines that were invalid or otherwise
+	// couldn't be turned into a rewrite item.
+	Skipped int `json:"skipped"`
+}
+
+// ImportHosts adds A/AAAA rewrites parsed from r, which must follow the
+// standard /etc/hosts syntax: "IP  domain [domain...]", with "#" starting a
+// comment.  All additions are batched behind a single rule-engine rebuild.
+func (s *DefaultStorage) ImportHosts(r io.Reader) (sum ImportSummary, err error) {
+	items, sum := parseHosts(r)
+
+	return s.importBatch(items, sum)
+}
+
+// parseHosts parses r as a hosts file and returns the resulting items, along
+// with the count of lines that were skipped.
+func parseHosts(r io.Reader) (items []*Item, sum ImportSummary) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			if strings.TrimSpace(line) != "" {
+				sum.Skipped++
+			}
+
+			continue
+		}
+
+		ans := fields[0]
+		if net.ParseIP(ans) == nil {
+			sum.Skipped++
+
+			continue
+		}
+
+		for _, domain := range fields[1:] {
+			it := &Item{Domain: domain, Answer: ans}
+			if err := it.Normalize(); err != nil {
+				sum.Skipped++
+
+				continue
+			}
+
+			items = append(items, it)
+		}
+	}
+
+	return items, sum
+}
+
+// ImportRPZ adds rewrites parsed from r, which must be a Response Policy
+// Zone (RPZ) zone file.  A trigger like "qname.rpz. A 1.2.3.4" becomes an
+// A rewrite for "qname", and "qname.rpz. CNAME ." becomes an
+// NXDOMAIN-equivalent exception.  All additions are batched behind a single
+// rule-engine rebuild.
+func (s *DefaultStorage) ImportRPZ(r io.Reader) (sum ImportSummary, err error) {
+	items, sum := parseRPZ(r)
+
+	return s.importBatch(items, sum)
+}
+
+// parseRPZ parses r as an RPZ zone file and returns the resulting items,
+// along with the count of lines that were skipped.
+func parseRPZ(r io.Reader) (items []*Item, sum ImportSummary) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, ';'); i != -1 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		name, typ, rdata, ok := parseRPZLine(line)
+		if !ok {
+			sum.Skipped++
+
+			continue
+		}
+
+		if typ == "CNAME" && rdata == "." {
+			items = append(items, &Item{Domain: strings.ToLower(name), NXDomain: true})
+
+			continue
+		}
+
+		it := &Item{Domain: name, Answer: rdata, Type: typ}
+		if err := it.Normalize(); err != nil {
+			sum.Skipped++
+
+			continue
+		}
+
+		items = append(items, it)
+	}
+
+	return items, sum
+}
+
+// parseRPZLine splits an RPZ zone file line into the trigger's domain name,
+// record type, and rdata.  It returns ok false if line doesn't look like a
+// resource record.
+func parseRPZLine(line string) (name, typ, rdata string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return "", "", "", false
+	}
+
+	name = strings.TrimSuffix(fields[0], ".")
+	name = strings.TrimSuffix(name, ".rpz")
+
+	typeIdx := -1
+	for i := 1; i < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "A", "AAAA", "CNAME":
+			typeIdx = i
+		default:
+			// A TTL, class ("IN"), or other marker; skip over it.
+		}
+
+		if typeIdx != -1 {
+			break
+		}
+	}
+
+	if typeIdx == -1 || typeIdx == len(fields)-1 {
+		return "", "", "", false
+	}
+
+	return name, strings.ToUpper(fields[typeIdx]), strings.Join(fields[typeIdx+1:], " "), true
+}
+
+// importBatch adds items to s under a single lock and a single rule-engine
+// rebuild, skipping duplicates of already-present items (including
+// duplicates within items itself).
+func (s *DefaultStorage) importBatch(items []*Item, sum ImportSummary) (res ImportSummary, err error) {
+	res = sum
+
+	s.mu.Lock()
+
+	var toAdd []*Item
+	for _, it := range items {
+		k := it.key()
+		if _, ok := s.index[k]; ok {
+			res.Duplicate++
+
+			continue
+		}
+
+		s.index[k] = it
+		toAdd = append(toAdd, it)
+	}
+	res.Added += len(toAdd)
+
+	s.rewrites = append(s.rewrites, toAdd...)
+	s.mu.Unlock()
+
+	s.rb.trigger()
+
+	return res, nil
+}
+
+// ExportHosts writes all A and AAAA rewrites in s to w using the standard
+// /etc/hosts syntax.
+func (s *DefaultStorage) ExportHosts(w io.Writer) (err error) {
+	s.mu.RLock()
+	rewrites := make([]*Item, len(s.rewrites))
+	copy(rewrites, s.rewrites)
+	s.mu.RUnlock()
+
+	n := 0
+	for _, it := range rewrites {
+		if it.Exception || it.NXDomain {
+			continue
+		}
+
+		if it.RRType != dns.TypeA && it.RRType != dns.TypeAAAA {
+			continue
+		}
+
+		for _, ans := range it.allAnswers() {
+			_, err = fmt.Fprintf(w, "%s %s\n", ans, it.Domain)
+			if err != nil {
+				return fmt.Errorf("writing hosts line: %w", err)
+			}
+
+			n++
+		}
+	}
+
+	log.Debug("rewrite: exported %d hosts entries", n)
+
+	return nil
+}
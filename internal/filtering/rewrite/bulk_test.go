@@ -0,0 +1,74 @@
+package rewrite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultStorage_ImportHosts(t *testing.T) {
+	s, err := NewDefaultStorage(-1, nil)
+	require.NoError(t, err)
+
+	hosts := strings.Join([]string{
+		"# a comment",
+		"1.2.3.4 example.com www.example.com",
+		"bad line with no ip",
+		"",
+	}, "\n")
+
+	sum, err := s.ImportHosts(strings.NewReader(hosts))
+	require.NoError(t, err)
+
+	require.Equal(t, 2, sum.Added)
+	require.Equal(t, 1, sum.Skipped)
+	require.Equal(t, 0, sum.Duplicate)
+	require.Len(t, s.List(), 2)
+
+	sum, err = s.ImportHosts(strings.NewReader("1.2.3.4 example.com"))
+	require.NoError(t, err)
+	require.Equal(t, 0, sum.Added)
+	require.Equal(t, 1, sum.Duplicate)
+}
+
+func TestDefaultStorage_ImportRPZ(t *testing.T) {
+	s, err := NewDefaultStorage(-1, nil)
+	require.NoError(t, err)
+
+	rpz := strings.Join([]string{
+		"blocked.rpz. A 1.2.3.4",
+		"nx.rpz. CNAME .",
+	}, "\n")
+
+	sum, err := s.ImportRPZ(strings.NewReader(rpz))
+	require.NoError(t, err)
+
+	require.Equal(t, 2, sum.Added)
+
+	list := s.List()
+	require.Len(t, list, 2)
+}
+
+func TestDefaultStorage_ExportHosts(t *testing.T) {
+	items := []*Item{{
+		Domain: "example.com",
+		Answer: "1.2.3.4",
+	}, {
+		Domain:  "multi.example.com",
+		Answers: []string{"1.1.1.1", "2.2.2.2"},
+	}}
+	for _, it := range items {
+		require.NoError(t, it.Normalize())
+	}
+
+	s, err := NewDefaultStorage(-1, items)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	err = s.ExportHosts(buf)
+	require.NoError(t, err)
+
+	require.Equal(t, "1.2.3.4 example.com\n1.1.1.1 multi.example.com\n2.2.2.2 multi.example.com\n", buf.String())
+}
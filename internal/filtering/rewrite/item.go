@@ -3,6 +3,8 @@ package rewrite
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/AdguardTeam/golibs/errors"
@@ -14,16 +16,45 @@ type Item struct {
 	// Domain is the domain pattern for which this rewrite should work.
 	Domain string `yaml:"domain"`
 
-	// Answer is the IP address, canonical name, or one of the special
-	// values: "A" or "AAAA".
+	// Answer is the IP address, canonical name, or record-specific value
+	// (see Type), or one of the special values: "A" or "AAAA".  It is kept
+	// for backward compatibility; new configs should prefer Answers.
 	Answer string `yaml:"answer"`
 
-	// Type is the DNS record type: A, AAAA, or CNAME.
-	Type uint16 `yaml:"-"`
+	// Answers is the list of answers to hand out for Domain.  When it
+	// contains more than one entry of the requested type,
+	// DefaultStorage.MatchRequest rotates through them round-robin and
+	// returns one per request.  If empty, Answer is used instead.
+	Answers []string `yaml:"answers,omitempty"`
+
+	// Type is the DNS record type, for example "A", "AAAA", "CNAME", "MX",
+	// "TXT", "SRV", "HTTPS", or "SVCB".  It may be left empty, in which case
+	// it is inferred from Answer, for backward compatibility with configs
+	// that predate explicit typing.
+	Type string `yaml:"type,omitempty"`
+
+	// Clients is the optional list of client identifiers (IDs, MAC
+	// addresses, or CIDRs) or persistent-client tag names (for example
+	// "user_admin") that this rewrite is scoped to.  An empty Clients means
+	// the rewrite applies regardless of the requesting client.
+	Clients []string `yaml:"clients,omitempty"`
+
+	// TTL, if non-zero, overrides the default TTL used when the resolver
+	// builds a response from this rewrite.
+	TTL uint32 `yaml:"ttl,omitempty"`
+
+	// RRType is the resolved numeric DNS record type that corresponds to
+	// Type, set by Normalize.
+	RRType uint16 `yaml:"-"`
 
 	// Exception is the flag to create exception rules with Domain special
 	// values "A" or "AAAA".
 	Exception bool `yaml:"-"`
+
+	// NXDomain marks rw as an unconditional NXDOMAIN response, regardless
+	// of Answer and Type.  It's used for RPZ "CNAME ." triggers imported
+	// via DefaultStorage.ImportRPZ.
+	NXDomain bool `yaml:"-"`
 }
 
 // equal returns true if rw is equal to other.
@@ -34,20 +65,119 @@ func (rw *Item) equal(other *Item) (ok bool) {
 		return false
 	}
 
-	return rw.Domain == other.Domain && rw.Answer == other.Answer
+	return rw.key() == other.key()
+}
+
+// allAnswers returns the answers configured for rw, preferring Answers over
+// the legacy single Answer field.
+func (rw *Item) allAnswers() (answers []string) {
+	if len(rw.Answers) > 0 {
+		return rw.Answers
+	}
+
+	return []string{rw.Answer}
+}
+
+// key returns a string that uniquely identifies rw for deduplication
+// purposes.  Two items with the same Domain and Type but different
+// Answers, Clients, or TTL are considered distinct: the first two produce
+// different rule text, and TTL changes the TTL reported by
+// DefaultStorage.TTL.
+func (rw *Item) key() (k string) {
+	nx := byte('0')
+	if rw.NXDomain {
+		nx = '1'
+	}
+
+	clients := append([]string(nil), rw.Clients...)
+	sort.Strings(clients)
+
+	return strings.Join([]string{
+		rw.Domain,
+		rw.Type,
+		strings.Join(rw.allAnswers(), ","),
+		strings.Join(clients, ","),
+		strconv.FormatUint(uint64(rw.TTL), 10),
+		string(nx),
+	}, "\x00")
 }
 
-// toRule converts rw to a filter rule.
-func (rw *Item) toRule() (res string) {
+// toRules converts rw to one filter rule per configured answer.
+func (rw *Item) toRules() (res []string) {
+	mods := rw.clientModifiers()
+
+	if rw.NXDomain {
+		return []string{fmt.Sprintf("|%s^$dnsrewrite=NXDOMAIN%s", rw.Domain, mods)}
+	}
+
 	if rw.Exception {
-		return fmt.Sprintf("@@||%s^$dnstype=%s,dnsrewrite", rw.Domain, dns.TypeToString[rw.Type])
+		return []string{
+			fmt.Sprintf("@@||%s^$dnstype=%s,dnsrewrite%s", rw.Domain, dns.TypeToString[rw.RRType], mods),
+		}
+	}
+
+	answers := rw.allAnswers()
+	res = make([]string, len(answers))
+	for i, ans := range answers {
+		res[i] = fmt.Sprintf(
+			"|%s^$dnsrewrite=NOERROR;%s;%s%s",
+			rw.Domain,
+			dns.TypeToString[rw.RRType],
+			ans,
+			mods,
+		)
+	}
+
+	return res
+}
+
+// clientTagPrefixes are the prefixes that identify a Clients entry as a
+// persistent-client tag name (as opposed to a client ID, MAC, or CIDR).
+var clientTagPrefixes = []string{"user_", "device_", "os_"}
+
+// isClientTag returns true if c looks like a persistent-client tag name
+// rather than a client identifier.
+func isClientTag(c string) (ok bool) {
+	for _, p := range clientTagPrefixes {
+		if strings.HasPrefix(c, p) {
+			return true
+		}
 	}
 
-	return fmt.Sprintf("|%s^$dnsrewrite=NOERROR;%s;%s", rw.Domain, dns.TypeToString[rw.Type], rw.Answer)
+	return false
+}
+
+// clientModifiers returns the "$client"/"$ctag" rule modifiers for rw, or
+// an empty string if rw isn't scoped to specific clients.  It relies on the
+// underlying urlfilter engine matching those modifiers against the
+// client's resolved ID, IP, MAC, or tags.
+func (rw *Item) clientModifiers() (mods string) {
+	if len(rw.Clients) == 0 {
+		return ""
+	}
+
+	var ids, tags []string
+	for _, c := range rw.Clients {
+		if isClientTag(c) {
+			tags = append(tags, c)
+		} else {
+			ids = append(ids, c)
+		}
+	}
+
+	if len(ids) > 0 {
+		mods += ",client=" + strings.Join(ids, "|")
+	}
+
+	if len(tags) > 0 {
+		mods += ",ctag=" + strings.Join(tags, "|")
+	}
+
+	return mods
 }
 
 // Normalize makes sure that rw as a new or decoded entry is normalized
-// regarding domain name case, IP length, and so on.
+// regarding domain name case, answer type, and so on.
 //
 // If rw is nil, it returns an error.
 func (rw *Item) Normalize() (err error) {
@@ -62,12 +192,14 @@ func (rw *Item) Normalize() (err error) {
 
 	switch rw.Answer {
 	case "AAAA":
-		rw.Type = dns.TypeAAAA
+		rw.RRType = dns.TypeAAAA
+		rw.Type = "AAAA"
 		rw.Exception = true
 
 		return nil
 	case "A":
-		rw.Type = dns.TypeA
+		rw.RRType = dns.TypeA
+		rw.Type = "A"
 		rw.Exception = true
 
 		return nil
@@ -75,18 +207,167 @@ func (rw *Item) Normalize() (err error) {
 		// Go on.
 	}
 
-	ip := net.ParseIP(rw.Answer)
+	if rw.Type == "" {
+		return rw.normalizeImplicit()
+	}
+
+	return rw.normalizeTyped()
+}
+
+// normalizeImplicit sets rw.RRType and rw.Type by inferring them from the
+// first configured answer, for rewrites that don't set Type explicitly, and
+// validates that every other configured answer also matches the inferred
+// type.
+func (rw *Item) normalizeImplicit() (err error) {
+	answers := rw.allAnswers()
+
+	ip := net.ParseIP(answers[0])
 	if ip == nil {
-		rw.Type = dns.TypeCNAME
+		rw.RRType = dns.TypeCNAME
+		rw.Type = "CNAME"
+	} else if ip4 := ip.To4(); ip4 != nil {
+		rw.RRType = dns.TypeA
+	} else {
+		rw.RRType = dns.TypeAAAA
+	}
+	rw.Type = dns.TypeToString[rw.RRType]
+
+	validate := answerValidator(rw.RRType)
+	for _, ans := range answers {
+		if err = validate(ans); err != nil {
+			return fmt.Errorf("validating answer for inferred type %s: %w", rw.Type, err)
+		}
+	}
+
+	return nil
+}
+
+// normalizeTyped validates the configured answers against the explicitly
+// set rw.Type and sets rw.RRType accordingly.
+func (rw *Item) normalizeTyped() (err error) {
+	typ := strings.ToUpper(rw.Type)
 
+	rrType, ok := dns.StringToType[typ]
+	if !ok {
+		return fmt.Errorf("unknown rewrite type %q", rw.Type)
+	}
+
+	validate := answerValidator(rrType)
+	if validate == nil {
+		return fmt.Errorf("unsupported rewrite type %q", rw.Type)
+	}
+
+	for _, ans := range rw.allAnswers() {
+		if err = validate(ans); err != nil {
+			return fmt.Errorf("validating answer for type %s: %w", typ, err)
+		}
+	}
+
+	rw.RRType = rrType
+	rw.Type = typ
+
+	return nil
+}
+
+// answerValidator returns the answer validation function for rrType, or nil
+// if rrType isn't supported.
+func answerValidator(rrType uint16) (validate func(ans string) (err error)) {
+	switch rrType {
+	case dns.TypeA:
+		return validateAnswerA
+	case dns.TypeAAAA:
+		return validateAnswerAAAA
+	case dns.TypeCNAME, dns.TypeTXT:
+		return validateAnswerNotEmpty
+	case dns.TypeMX:
+		return validateAnswerMX
+	case dns.TypeSRV:
+		return validateAnswerSRV
+	case dns.TypeHTTPS, dns.TypeSVCB:
+		return validateAnswerSVCB
+	default:
 		return nil
 	}
+}
 
-	ip4 := ip.To4()
-	if ip4 != nil {
-		rw.Type = dns.TypeA
-	} else {
-		rw.Type = dns.TypeAAAA
+// validateAnswerNotEmpty returns an error if ans is empty.
+func validateAnswerNotEmpty(ans string) (err error) {
+	if ans == "" {
+		return errors.Error("answer is empty")
+	}
+
+	return nil
+}
+
+// validateAnswerA returns an error if ans is not a valid IPv4 address.
+func validateAnswerA(ans string) (err error) {
+	ip := net.ParseIP(ans)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("%q is not a valid ipv4 address", ans)
+	}
+
+	return nil
+}
+
+// validateAnswerAAAA returns an error if ans is not a valid IPv6 address.
+func validateAnswerAAAA(ans string) (err error) {
+	ip := net.ParseIP(ans)
+	if ip == nil || ip.To4() != nil {
+		return fmt.Errorf("%q is not a valid ipv6 address", ans)
+	}
+
+	return nil
+}
+
+// validateAnswerMX returns an error if ans is not a valid MX answer of the
+// form "preference exchange", for example "10 mail.example.com.".
+func validateAnswerMX(ans string) (err error) {
+	fields := strings.Fields(ans)
+	if len(fields) != 2 {
+		return fmt.Errorf(`%q should be in the form "preference exchange"`, ans)
+	}
+
+	if _, err = strconv.ParseUint(fields[0], 10, 16); err != nil {
+		return fmt.Errorf("preference: %w", err)
+	}
+
+	return nil
+}
+
+// validateAnswerSRV returns an error if ans is not a valid SRV answer of the
+// form "priority weight port target", for example "0 5 5060 sip.example.com.".
+func validateAnswerSRV(ans string) (err error) {
+	fields := strings.Fields(ans)
+	if len(fields) != 4 {
+		return fmt.Errorf(`%q should be in the form "priority weight port target"`, ans)
+	}
+
+	for _, f := range fields[:3] {
+		if _, err = strconv.ParseUint(f, 10, 16); err != nil {
+			return fmt.Errorf("numeric field: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// validateAnswerSVCB returns an error if ans is not a valid SVCB/HTTPS answer
+// of the form "priority target [param=value ...]", for example
+// "1 . alpn=h3 ipv4hint=1.2.3.4".
+func validateAnswerSVCB(ans string) (err error) {
+	fields := strings.Fields(ans)
+	if len(fields) < 2 {
+		return fmt.Errorf(`%q should be in the form "priority target [params]"`, ans)
+	}
+
+	if _, err = strconv.ParseUint(fields[0], 10, 16); err != nil {
+		return fmt.Errorf("priority: %w", err)
+	}
+
+	for _, p := range fields[2:] {
+		if !strings.Contains(p, "=") {
+			return fmt.Errorf("param %q should be in the form key=value", p)
+		}
 	}
 
 	return nil
@@ -0,0 +1,167 @@
+package rewrite
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestItem_Normalize(t *testing.T) {
+	t.Run("exception", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "A"}
+		require.NoError(t, item.Normalize())
+		require.Equal(t, dns.TypeA, item.RRType)
+		require.True(t, item.Exception)
+	})
+
+	t.Run("implicit_cname", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "other.example.com"}
+		require.NoError(t, item.Normalize())
+		require.Equal(t, dns.TypeCNAME, item.RRType)
+		require.Equal(t, "CNAME", item.Type)
+	})
+
+	t.Run("implicit_a", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "1.2.3.4"}
+		require.NoError(t, item.Normalize())
+		require.Equal(t, dns.TypeA, item.RRType)
+	})
+
+	t.Run("implicit_aaaa", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "::1"}
+		require.NoError(t, item.Normalize())
+		require.Equal(t, dns.TypeAAAA, item.RRType)
+	})
+
+	t.Run("typed_mx", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "10 mail.example.com.", Type: "mx"}
+		require.NoError(t, item.Normalize())
+		require.Equal(t, dns.TypeMX, item.RRType)
+		require.Equal(t, "MX", item.Type)
+	})
+
+	t.Run("typed_srv", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "0 5 5060 sip.example.com.", Type: "srv"}
+		require.NoError(t, item.Normalize())
+		require.Equal(t, dns.TypeSRV, item.RRType)
+	})
+
+	t.Run("typed_https", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "1 . alpn=h3", Type: "https"}
+		require.NoError(t, item.Normalize())
+		require.Equal(t, dns.TypeHTTPS, item.RRType)
+	})
+
+	t.Run("typed_txt", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "hello world", Type: "txt"}
+		require.NoError(t, item.Normalize())
+		require.Equal(t, dns.TypeTXT, item.RRType)
+	})
+
+	t.Run("unknown_type", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "1.2.3.4", Type: "bogus"}
+		require.Error(t, item.Normalize())
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var item *Item
+		require.Error(t, item.Normalize())
+	})
+}
+
+func TestItem_toRules(t *testing.T) {
+	t.Run("single_answer", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "1.2.3.4"}
+		require.NoError(t, item.Normalize())
+
+		require.Equal(t, []string{
+			"|example.com^$dnsrewrite=NOERROR;A;1.2.3.4",
+		}, item.toRules())
+	})
+
+	t.Run("multiple_answers", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answers: []string{"1.2.3.4", "5.6.7.8"}}
+		require.NoError(t, item.Normalize())
+
+		require.Equal(t, []string{
+			"|example.com^$dnsrewrite=NOERROR;A;1.2.3.4",
+			"|example.com^$dnsrewrite=NOERROR;A;5.6.7.8",
+		}, item.toRules())
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		item := &Item{Domain: "example.com", NXDomain: true}
+
+		require.Equal(t, []string{
+			"|example.com^$dnsrewrite=NXDOMAIN",
+		}, item.toRules())
+	})
+
+	t.Run("exception", func(t *testing.T) {
+		item := &Item{Domain: "example.com", Answer: "A"}
+		require.NoError(t, item.Normalize())
+
+		require.Equal(t, []string{
+			"@@||example.com^$dnstype=A,dnsrewrite",
+		}, item.toRules())
+	})
+
+	t.Run("client_scoped", func(t *testing.T) {
+		item := &Item{
+			Domain:  "example.com",
+			Answer:  "1.2.3.4",
+			Clients: []string{"192.168.1.1", "user_admin"},
+		}
+		require.NoError(t, item.Normalize())
+
+		require.Equal(t, []string{
+			"|example.com^$dnsrewrite=NOERROR;A;1.2.3.4,client=192.168.1.1,ctag=user_admin",
+		}, item.toRules())
+	})
+}
+
+func TestValidateAnswerMX(t *testing.T) {
+	require.NoError(t, validateAnswerMX("10 mail.example.com."))
+	require.Error(t, validateAnswerMX("mail.example.com."))
+	require.Error(t, validateAnswerMX("not-a-number mail.example.com."))
+}
+
+func TestValidateAnswerSRV(t *testing.T) {
+	require.NoError(t, validateAnswerSRV("0 5 5060 sip.example.com."))
+	require.Error(t, validateAnswerSRV("5060 sip.example.com."))
+	require.Error(t, validateAnswerSRV("0 5 not-a-port sip.example.com."))
+}
+
+func TestValidateAnswerSVCB(t *testing.T) {
+	require.NoError(t, validateAnswerSVCB("1 ."))
+	require.NoError(t, validateAnswerSVCB("1 . alpn=h3 ipv4hint=1.2.3.4"))
+	require.Error(t, validateAnswerSVCB("."))
+	require.Error(t, validateAnswerSVCB("not-a-number ."))
+	require.Error(t, validateAnswerSVCB("1 . alpn"))
+}
+
+// TestNewDefaultStorage_NewTypes checks that rewrites of the new record
+// types are accepted by the real urlfilter engine, not just by Normalize.
+func TestNewDefaultStorage_NewTypes(t *testing.T) {
+	items := []*Item{
+		{Domain: "mx.example.com", Answer: "10 mail.example.com", Type: "mx"},
+		{Domain: "srv.example.com", Answer: "0 5 5060 sip.example.com", Type: "srv"},
+		{Domain: "txt.example.com", Answer: "hello world", Type: "txt"},
+		{Domain: "https.example.com", Answer: "1 . alpn=h3", Type: "https"},
+		{Domain: "svcb.example.com", Answer: "1 . alpn=h3", Type: "svcb"},
+	}
+	for _, it := range items {
+		require.NoError(t, it.Normalize())
+	}
+
+	s, err := NewDefaultStorage(-1, items)
+	require.NoError(t, err)
+
+	for _, it := range items {
+		dReq := &urlfilter.DNSRequest{Hostname: it.Domain, DNSType: it.RRType}
+		res, _ := s.MatchRequest(dReq)
+		require.NotEmpty(t, res.NetworkRules, "type %s", it.Type)
+	}
+}
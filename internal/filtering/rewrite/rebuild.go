@@ -0,0 +1,99 @@
+package rewrite
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// rebuildDebounce is how long a triggered rebuild waits before it actually
+// compiles, so that a burst of individual Add/Remove calls arriving close
+// together collapses into a single engine compile instead of one per call.
+const rebuildDebounce = 50 * time.Millisecond
+
+// rebuildCoalescer debounces and coalesces calls to compile.  trigger
+// doesn't block the caller: it schedules a compile to run after
+// rebuildDebounce, and any further triggers that arrive before that compile
+// starts are absorbed into it instead of starting a compile of their own;
+// triggers that arrive while it's running make it run once more.  This guarantees there's never more than one
+// compile running at a time, so concurrent mutations can't race to install
+// a stale result, and a rapid burst of single-item Add/Remove calls pays
+// for a small, bounded number of compiles rather than one per call.
+type rebuildCoalescer struct {
+	// compile builds and installs the current state.  It's called with no
+	// other compile running concurrently.
+	compile func() error
+
+	mu        sync.Mutex
+	scheduled bool
+	dirty     bool
+}
+
+// trigger schedules a compile if one isn't already scheduled or running,
+// and otherwise marks the pending one dirty so that, if it's already
+// compiling, it runs once more to pick up this change.  It never blocks waiting for the compile itself; a
+// compile error is logged, since by the time it's known the caller that
+// triggered it is long gone.
+func (c *rebuildCoalescer) trigger() {
+	c.mu.Lock()
+	if c.scheduled {
+		c.dirty = true
+		c.mu.Unlock()
+
+		return
+	}
+
+	c.scheduled = true
+	c.mu.Unlock()
+
+	go c.run()
+}
+
+// wait blocks until any scheduled or in-progress compile triggered so far has
+// finished.  It exists for tests and benchmarks that need to measure or
+// observe the result of a compile directly, rather than just the cost of
+// scheduling one.
+func (c *rebuildCoalescer) wait() {
+	for {
+		c.mu.Lock()
+		scheduled := c.scheduled
+		c.mu.Unlock()
+
+		if !scheduled {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// run compiles, debounced, and repeats if more triggers arrived while it
+// compiled.
+func (c *rebuildCoalescer) run() {
+	for {
+		time.Sleep(rebuildDebounce)
+
+		// Triggers that arrived during the debounce are covered by the compile
+		// below, so they mustn't cause another one.
+		c.mu.Lock()
+		c.dirty = false
+		c.mu.Unlock()
+
+		if err := c.compile(); err != nil {
+			log.Error("rewrite: rebuilding filtering engine: %s", err)
+		}
+
+		c.mu.Lock()
+		again := c.dirty
+		c.dirty = false
+		if !again {
+			c.scheduled = false
+		}
+		c.mu.Unlock()
+
+		if !again {
+			return
+		}
+	}
+}
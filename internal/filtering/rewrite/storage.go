@@ -3,43 +3,81 @@ package rewrite
 
 import (
 	"fmt"
-	"net"
+	"io"
 	"strings"
 	"sync"
+	"sync/atomic"
 
-	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
-	"github.com/miekg/dns"
+	"github.com/AdguardTeam/urlfilter/rules"
 	"golang.org/x/exp/slices"
 )
 
 // Storage is a storage for rewrite rules.
 type Storage interface {
 	// MatchRequest finds a matching rule for the specified request.
+	// Client- and tag-scoped rewrites (see Item.Clients) are matched by
+	// the underlying urlfilter engine itself, against whatever client
+	// identity the caller has already resolved and set on dReq.ClientIP,
+	// dReq.ClientName, and dReq.SortedClientTags; resolving that identity
+	// from the incoming DNS request is the caller's responsibility, not
+	// this package's.
 	MatchRequest(dReq *urlfilter.DNSRequest) (res *urlfilter.DNSResult, matched bool)
 
-	// Add adds item to the storage.
+	// Add adds item to the storage.  The change is visible to List
+	// immediately, but MatchRequest only picks it up once a debounced
+	// engine rebuild runs, shortly afterwards.
 	Add(item *Item) (err error)
 
-	// Remove deletes item from the storage.
+	// AddBatch adds items to the storage.  Like Add, it only schedules a
+	// rebuild instead of waiting for one, rather than rebuilding the
+	// underlying filtering engine once per item.
+	AddBatch(items []*Item) (err error)
+
+	// Remove deletes item from the storage.  See Add for when the change
+	// becomes visible to MatchRequest.
 	Remove(item *Item) (err error)
 
+	// RemoveBatch deletes items from the storage.  See AddBatch for how
+	// rebuilds are scheduled.
+	RemoveBatch(items []*Item) (err error)
+
 	// List returns all items from the storage.
 	List() (items []*Item)
+
+	// ImportHosts adds A/AAAA rewrites parsed from r in /etc/hosts syntax.
+	ImportHosts(r io.Reader) (sum ImportSummary, err error)
+
+	// ImportRPZ adds rewrites parsed from r, an RPZ zone file.
+	ImportRPZ(r io.Reader) (sum ImportSummary, err error)
+
+	// ExportHosts writes all A and AAAA rewrites in the storage to w using
+	// the standard /etc/hosts syntax.
+	ExportHosts(w io.Writer) (err error)
+}
+
+// engineState is the filtering engine together with the rule list backing
+// it, swapped in as a unit so that readers never observe a half-updated
+// pair.
+type engineState struct {
+	engine   *urlfilter.DNSEngine
+	ruleList filterlist.RuleList
 }
 
 // DefaultStorage is the default storage for rewrite rules.
+//
+// Reads (MatchRequest) never block on writes: writers build a new
+// engineState off to the side and swap it in atomically, so a rebuild in
+// progress never holds up request matching.
 type DefaultStorage struct {
-	// mu protects items.
+	// mu protects rewrites and index.
 	mu *sync.RWMutex
 
-	// engine is the DNS filtering engine.
-	engine *urlfilter.DNSEngine
-
-	// ruleList is the filtering rule ruleList used by the engine.
-	ruleList filterlist.RuleList
+	// state holds the current filtering engine.  It's accessed through
+	// atomic.Pointer instead of mu so MatchRequest is lock-free.
+	state atomic.Pointer[engineState]
 
 	// urlFilterID is the synthetic integer identifier for the urlfilter engine.
 	//
@@ -47,155 +85,211 @@ type DefaultStorage struct {
 	// remove this crutch.
 	urlFilterID int
 
-	// rewrites is an array of rewrite items.
+	// rewrites is an array of rewrite items, in insertion order.
 	// TODO(d.kolyshev): Use filtering.Config.Rewrites?
 	rewrites []*Item
-}
 
-// Item is a single DNS rewrite record.
-type Item struct {
-	// Domain is the domain pattern for which this rewrite should work.
-	Domain string `yaml:"domain"`
+	// index maps each item's (*Item).key() to the item itself, for O(1)
+	// duplicate detection and removal.
+	index map[string]*Item
 
-	// Answer is the IP address, canonical name, or one of the special
-	// values: "A" or "AAAA".
-	Answer string `yaml:"answer"`
+	// counterMu protects roundRobin.
+	counterMu sync.Mutex
 
-	// Type is the DNS record type: A, AAAA, or CNAME.
-	Type uint16 `yaml:"-"`
+	// roundRobin holds the per domain+type counters used to rotate through
+	// multi-answer rewrites.  It is created lazily.
+	roundRobin map[string]*uint32
 
-	// Exception is the flag to create exception rules with Domain special
-	// values "A" or "AAAA".
-	Exception bool `yaml:"-"`
+	// rb debounces and coalesces calls to compile, so that concurrent
+	// Add/Remove calls can never race to install a stale engineState, and a
+	// burst of single-item calls pays for a small, bounded number of
+	// compiles instead of one per call.
+	rb rebuildCoalescer
 }
 
-// equal returns true if rw is equal to other.
-func (rw *Item) equal(other *Item) (ok bool) {
-	if rw == nil {
-		return other == nil
-	} else if other == nil {
-		return false
+// NewDefaultStorage returns new rewrites storage.  listID is used as an
+// identifier of the underlying rules list.  rewrites must not be nil.
+func NewDefaultStorage(listID int, rewrites []*Item) (s *DefaultStorage, err error) {
+	s = &DefaultStorage{
+		mu:          &sync.RWMutex{},
+		urlFilterID: listID,
+		rewrites:    rewrites,
+		index:       make(map[string]*Item, len(rewrites)),
 	}
+	s.rb.compile = s.compile
 
-	return rw.Domain == other.Domain && rw.Answer == other.Answer
-}
+	for _, it := range rewrites {
+		s.index[it.key()] = it
+	}
 
-// toRule converts this item to a filter rule.
-func (rw *Item) toRule() (res string) {
-	if rw.Exception {
-		return fmt.Sprintf("@@||%s^$dnstype=%s,dnsrewrite", rw.Domain, dns.TypeToString[rw.Type])
+	err = s.compile()
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Sprintf("|%s^$dnsrewrite=NOERROR;%s;%s", rw.Domain, dns.TypeToString[rw.Type], rw.Answer)
+	return s, nil
 }
 
-// Normalize makes sure that the a new or decoded entry is normalized with
-// regards to domain name case, IP length, and so on.
-//
-// If rw is nil, it returns an errors.
-func (rw *Item) Normalize() (err error) {
-	if rw == nil {
-		return errors.Error("nil rewrite entry")
-	}
+// type check
+var _ Storage = (*DefaultStorage)(nil)
 
-	// TODO(a.garipov): Write a case-agnostic version of strings.HasSuffix and
-	// use it in matchDomainWildcard instead of using strings.ToLower
-	// everywhere.
-	rw.Domain = strings.ToLower(rw.Domain)
+// MatchRequest implements the Storage interface for *DefaultStorage.  When
+// the match contains more than one $dnsrewrite rule for dReq's own record
+// type--meaning the matched item had multiple Answers--it is narrowed down
+// to a single one, chosen round-robin, so that successive requests rotate
+// through the configured answers instead of all being handed back together.
+func (s *DefaultStorage) MatchRequest(dReq *urlfilter.DNSRequest) (res *urlfilter.DNSResult, matched bool) {
+	st := s.state.Load()
+	if st == nil {
+		return nil, false
+	}
 
-	switch rw.Answer {
-	case "AAAA":
-		rw.Type = dns.TypeAAAA
-		rw.Exception = true
+	res, matched = st.engine.MatchRequest(dReq)
+	s.pickRoundRobin(dReq, res)
 
-		return nil
-	case "A":
-		rw.Type = dns.TypeA
-		rw.Exception = true
+	return res, matched
+}
 
-		return nil
-	default:
-		// Go on.
+// pickRoundRobin narrows res.NetworkRules down to a single $dnsrewrite rule
+// matching dReq.Hostname and dReq.DNSType, chosen round-robin via
+// nextRoundRobinIndex, whenever more than one such rule matched.  It leaves
+// res untouched otherwise, including for nil res and host-rule-only matches.
+func (s *DefaultStorage) pickRoundRobin(dReq *urlfilter.DNSRequest, res *urlfilter.DNSResult) {
+	if res == nil {
+		return
 	}
 
-	ip := net.ParseIP(rw.Answer)
-	if ip == nil {
-		rw.Type = dns.TypeCNAME
-
-		return nil
+	var candidates []*rules.NetworkRule
+	for _, nr := range res.DNSRewrites() {
+		if nr.DNSRewrite.RRType == dReq.DNSType {
+			candidates = append(candidates, nr)
+		}
 	}
 
-	ip4 := ip.To4()
-	if ip4 != nil {
-		rw.Type = dns.TypeA
-	} else {
-		rw.Type = dns.TypeAAAA
+	if len(candidates) < 2 {
+		return
 	}
 
-	return nil
+	picked := candidates[s.nextRoundRobinIndex(dReq.Hostname, dReq.DNSType, len(candidates))]
+	res.NetworkRules = []*rules.NetworkRule{picked}
+	res.NetworkRule = picked
 }
 
-// NewDefaultStorage returns new rewrites storage.  listID is used as an
-// identifier of the underlying rules list.  rewrites must not be nil.
-func NewDefaultStorage(listID int, rewrites []*Item) (s *DefaultStorage, err error) {
-	s = &DefaultStorage{
-		mu:          &sync.RWMutex{},
-		urlFilterID: listID,
-		rewrites:    rewrites,
+// nextRoundRobinIndex returns the next index into a slice of n candidates
+// for the given domain and record type, rotating round-robin across
+// successive calls.  It panics if n is 0.
+func (s *DefaultStorage) nextRoundRobinIndex(domain string, rrType uint16, n int) (idx int) {
+	key := fmt.Sprintf("%s|%d", domain, rrType)
+
+	s.counterMu.Lock()
+	if s.roundRobin == nil {
+		s.roundRobin = map[string]*uint32{}
+	}
+	ctr, ok := s.roundRobin[key]
+	if !ok {
+		ctr = new(uint32)
+		s.roundRobin[key] = ctr
 	}
+	s.counterMu.Unlock()
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return int((atomic.AddUint32(ctr, 1) - 1) % uint32(n))
+}
 
-	err = s.resetRules()
-	if err != nil {
-		return nil, err
+// NextRoundRobinAnswer returns the next answer for the given domain and
+// record type out of answers, rotating through them round-robin across
+// successive calls.  It panics if answers is empty.
+//
+// MatchRequest performs this same rotation itself for multi-answer items, so
+// callers that only go through MatchRequest don't need to call this
+// directly; it stays exported for callers that need to rotate through a set
+// of answers outside of a MatchRequest call.
+func (s *DefaultStorage) NextRoundRobinAnswer(
+	domain string,
+	rrType uint16,
+	answers []string,
+) (ans string) {
+	if len(answers) == 1 {
+		return answers[0]
 	}
 
-	return s, nil
+	return answers[s.nextRoundRobinIndex(domain, rrType, len(answers))]
 }
 
-// type check
-var _ Storage = (*DefaultStorage)(nil)
-
-// MatchRequest implements the Storage interface for *DefaultStorage.
-func (s *DefaultStorage) MatchRequest(dReq *urlfilter.DNSRequest) (res *urlfilter.DNSResult, matched bool) {
+// TTL returns the TTL configured for the first rewrite item that matches
+// domain and rrType, and whether such an item with a non-zero TTL was
+// found.  urlfilter.DNSResult has no TTL field of its own, so callers that
+// build a DNS response from a MatchRequest result are expected to call TTL
+// themselves to learn the TTL to use, rather than this package folding it
+// into the match result.
+func (s *DefaultStorage) TTL(domain string, rrType uint16) (ttl uint32, ok bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return s.engine.MatchRequest(dReq)
+	for _, it := range s.rewrites {
+		if it.Domain == domain && it.RRType == rrType && it.TTL > 0 {
+			return it.TTL, true
+		}
+	}
+
+	return 0, false
 }
 
 // Add implements the Storage interface for *DefaultStorage.
 func (s *DefaultStorage) Add(item *Item) (err error) {
+	return s.AddBatch([]*Item{item})
+}
+
+// AddBatch implements the Storage interface for *DefaultStorage.
+func (s *DefaultStorage) AddBatch(items []*Item) (err error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	s.rewrites = append(s.rewrites, item)
+	for _, it := range items {
+		k := it.key()
+		if _, ok := s.index[k]; ok {
+			continue
+		}
+
+		s.index[k] = it
+		s.rewrites = append(s.rewrites, it)
+	}
+
+	s.mu.Unlock()
 
-	return s.resetRules()
+	s.rb.trigger()
+
+	return nil
 }
 
 // Remove implements the Storage interface for *DefaultStorage.
-// TODO(d.kolyshev): Delete only current item.
 func (s *DefaultStorage) Remove(item *Item) (err error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.RemoveBatch([]*Item{item})
+}
 
-	arr := []*Item{}
+// RemoveBatch implements the Storage interface for *DefaultStorage.
+func (s *DefaultStorage) RemoveBatch(items []*Item) (err error) {
+	s.mu.Lock()
 
-	for _, ent := range s.rewrites {
-		if ent.equal(item) {
+	for _, item := range items {
+		k := item.key()
+		if ent, ok := s.index[k]; ok {
+			delete(s.index, k)
 			log.Debug("rewrite: removed element: %s -> %s", ent.Domain, ent.Answer)
-
-			continue
 		}
+	}
 
-		arr = append(arr, ent)
+	filtered := make([]*Item, 0, len(s.rewrites))
+	for _, ent := range s.rewrites {
+		if _, ok := s.index[ent.key()]; ok {
+			filtered = append(filtered, ent)
+		}
 	}
-	s.rewrites = arr
+	s.rewrites = filtered
+
+	s.mu.Unlock()
 
-	return s.resetRules()
+	s.rb.trigger()
+
+	return nil
 }
 
 // List implements the Storage interface for *DefaultStorage.
@@ -206,11 +300,18 @@ func (s *DefaultStorage) List() (items []*Item) {
 	return slices.Clone(s.rewrites)
 }
 
-// resetRules resets the filtering rules.
-func (s *DefaultStorage) resetRules() (err error) {
+// compile builds a new filtering engine from the current rewrites and
+// atomically swaps it in.  It's only ever called with no other compile
+// running concurrently (see rebuildCoalescer), so the swap can never race
+// with another one and install a stale result.
+func (s *DefaultStorage) compile() (err error) {
+	s.mu.RLock()
+	rewrites := slices.Clone(s.rewrites)
+	s.mu.RUnlock()
+
 	var rulesText []string
-	for _, rewrite := range s.rewrites {
-		rulesText = append(rulesText, rewrite.toRule())
+	for _, rewrite := range rewrites {
+		rulesText = append(rulesText, rewrite.toRules()...)
 	}
 
 	strList := &filterlist.StringRuleList{
@@ -224,10 +325,11 @@ func (s *DefaultStorage) resetRules() (err error) {
 		return fmt.Errorf("creating list storage: %w", err)
 	}
 
-	s.ruleList = strList
-	s.engine = urlfilter.NewDNSEngine(rs)
+	engine := urlfilter.NewDNSEngine(rs)
+
+	s.state.Store(&engineState{engine: engine, ruleList: strList})
 
-	log.Info("filter %d: reset %d rules", s.urlFilterID, s.engine.RulesCount)
+	log.Info("filter %d: reset %d rules", s.urlFilterID, engine.RulesCount)
 
 	return nil
 }
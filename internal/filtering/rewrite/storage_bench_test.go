@@ -0,0 +1,68 @@
+package rewrite
+
+import (
+	"fmt"
+	"testing"
+)
+
+// makeBenchItems returns n distinct A rewrites for benchmarking.
+func makeBenchItems(n int) (items []*Item) {
+	items = make([]*Item, n)
+	for i := range items {
+		items[i] = &Item{
+			Domain: fmt.Sprintf("host-%d.example.com", i),
+			Answer: "1.2.3.4",
+			Type:   "A",
+			RRType: 1,
+		}
+	}
+
+	return items
+}
+
+// BenchmarkDefaultStorage_Add measures adding items one at a time, including
+// the debounced rebuild(s) they trigger.  Add only schedules a compile
+// instead of running one synchronously, so a fast sequential burst like this
+// one coalesces into a small, bounded number of engine compiles rather than
+// one per call; rb.wait lets the benchmark include that compile time instead
+// of just the cost of scheduling it.
+func BenchmarkDefaultStorage_Add(b *testing.B) {
+	items := makeBenchItems(10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := NewDefaultStorage(-1, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, it := range items {
+			if err = s.Add(it); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		s.rb.wait()
+	}
+}
+
+// BenchmarkDefaultStorage_AddBatch measures adding the same items as a
+// single batch, which schedules only one rebuild for the whole batch, and
+// waits for that rebuild to finish.
+func BenchmarkDefaultStorage_AddBatch(b *testing.B) {
+	items := makeBenchItems(10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := NewDefaultStorage(-1, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if err = s.AddBatch(items); err != nil {
+			b.Fatal(err)
+		}
+
+		s.rb.wait()
+	}
+}
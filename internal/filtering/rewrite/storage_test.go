@@ -1,8 +1,11 @@
 package rewrite
 
 import (
+	"net/netip"
 	"testing"
 
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
@@ -38,3 +41,36 @@ func TestDefaultStorage_CRUD(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 0, len(s.List()))
 }
+
+func TestDefaultStorage_NextRoundRobinAnswer(t *testing.T) {
+	s, err := NewDefaultStorage(-1, nil)
+	require.NoError(t, err)
+
+	answers := []string{"1.2.3.4", "5.6.7.8", "9.10.11.12"}
+
+	var got []string
+	for i := 0; i < len(answers)*2; i++ {
+		got = append(got, s.NextRoundRobinAnswer("example.com", dns.TypeA, answers))
+	}
+
+	require.Equal(t, append(answers, answers...), got)
+}
+
+func TestDefaultStorage_MatchRequest_roundRobin(t *testing.T) {
+	item := &Item{Domain: "example.com", Answers: []string{"1.2.3.4", "5.6.7.8", "9.10.11.12"}}
+	require.NoError(t, item.Normalize())
+
+	s, err := NewDefaultStorage(-1, []*Item{item})
+	require.NoError(t, err)
+
+	dReq := &urlfilter.DNSRequest{Hostname: item.Domain, DNSType: dns.TypeA}
+
+	var got []string
+	for i := 0; i < len(item.Answers)*2; i++ {
+		res, _ := s.MatchRequest(dReq)
+		require.Len(t, res.NetworkRules, 1)
+		got = append(got, res.NetworkRules[0].DNSRewrite.Value.(netip.Addr).String())
+	}
+
+	require.Equal(t, append(item.Answers, item.Answers...), got)
+}
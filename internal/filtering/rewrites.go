@@ -30,8 +30,12 @@ func (d *DNSFilter) prepareRewrites() (err error) {
 }
 
 type rewriteEntryJSON struct {
-	Domain string `json:"domain"`
-	Answer string `json:"answer"`
+	Domain  string   `json:"domain"`
+	Answer  string   `json:"answer"`
+	Answers []string `json:"answers,omitempty"`
+	Type    string   `json:"type,omitempty"`
+	Clients []string `json:"clients,omitempty"`
+	TTL     uint32   `json:"ttl,omitempty"`
 }
 
 func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
@@ -40,8 +44,12 @@ func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
 	d.confLock.Lock()
 	for _, ent := range d.rewriteStorage.List() {
 		jsent := rewriteEntryJSON{
-			Domain: ent.Domain,
-			Answer: ent.Answer,
+			Domain:  ent.Domain,
+			Answer:  ent.Answer,
+			Answers: ent.Answers,
+			Type:    ent.Type,
+			Clients: ent.Clients,
+			TTL:     ent.TTL,
 		}
 		arr = append(arr, &jsent)
 	}
@@ -60,8 +68,12 @@ func (d *DNSFilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rw := &rewrite.Item{
-		Domain: rwJSON.Domain,
-		Answer: rwJSON.Answer,
+		Domain:  rwJSON.Domain,
+		Answer:  rwJSON.Answer,
+		Answers: rwJSON.Answers,
+		Type:    rwJSON.Type,
+		Clients: rwJSON.Clients,
+		TTL:     rwJSON.TTL,
 	}
 
 	err = rw.Normalize()
@@ -98,8 +110,12 @@ func (d *DNSFilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 	}
 
 	ent := &rewrite.Item{
-		Domain: jsent.Domain,
-		Answer: jsent.Answer,
+		Domain:  jsent.Domain,
+		Answer:  jsent.Answer,
+		Answers: jsent.Answers,
+		Type:    jsent.Type,
+		Clients: jsent.Clients,
+		TTL:     jsent.TTL,
 	}
 
 	d.confLock.Lock()
@@ -116,3 +132,66 @@ func (d *DNSFilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 
 	d.Config.ConfigModified()
 }
+
+// rewriteImportFormat is the format of a bulk rewrite import, as passed in
+// the "format" query parameter of handleRewriteImport.
+type rewriteImportFormat string
+
+const (
+	rewriteImportFormatHosts rewriteImportFormat = "hosts"
+	rewriteImportFormatRPZ   rewriteImportFormat = "rpz"
+)
+
+// handleRewriteImport reads a hosts-file or RPZ zone file from the request
+// body, as chosen by the "format" query parameter, and adds the resulting
+// rewrites in a single batch.
+func (d *DNSFilter) handleRewriteImport(w http.ResponseWriter, r *http.Request) {
+	format := rewriteImportFormat(r.URL.Query().Get("format"))
+
+	d.confLock.Lock()
+	defer d.confLock.Unlock()
+
+	var sum rewrite.ImportSummary
+	var err error
+	switch format {
+	case rewriteImportFormatHosts, "":
+		sum, err = d.rewriteStorage.ImportHosts(r.Body)
+	case rewriteImportFormatRPZ:
+		sum, err = d.rewriteStorage.ImportRPZ(r.Body)
+	default:
+		aghhttp.Error(r, w, http.StatusBadRequest, "unknown format %q", format)
+
+		return
+	}
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "importing rewrites: %s", err)
+
+		return
+	}
+
+	log.Debug(
+		"rewrite: imported %d, skipped %d, duplicate %d",
+		sum.Added,
+		sum.Skipped,
+		sum.Duplicate,
+	)
+
+	d.Config.ConfigModified()
+
+	_ = aghhttp.WriteJSONResponse(w, r, sum)
+}
+
+// handleRewriteExport writes all A/AAAA rewrites as a hosts file.
+func (d *DNSFilter) handleRewriteExport(w http.ResponseWriter, r *http.Request) {
+	d.confLock.Lock()
+	defer d.confLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	err := d.rewriteStorage.ExportHosts(w)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "exporting rewrites: %s", err)
+
+		return
+	}
+}